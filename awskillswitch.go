@@ -2,51 +2,251 @@ package main
 
 import (
 	"context"
+	_ "embed"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
 )
 
+//go:embed policies/default-switch-policies.json
+var defaultPolicyConfig []byte
+
 type Action string
 
 const (
-	ApplySCP       Action = "apply_scp"
-	DeleteRole     Action = "delete_role"
-	DetachPolicies Action = "detach_policies"
-	RevokeSessions Action = "revoke_sessions"
+	ApplySCP            Action = "apply_scp"
+	DeleteRole          Action = "delete_role"
+	DetachPolicies      Action = "detach_policies"
+	RevokeSessions      Action = "revoke_sessions"
+	QuarantinePrincipal Action = "quarantine_principal"
+	NukeIAM             Action = "nuke_iam"
+	FanOut              Action = "fan_out"
+	Undo                Action = "undo"
 	// Default region to be used if the region is not specified by the user
 	DefaultRegion = "us-east-1"
+	// Name of the inline policy quarantine_principal puts on the target user or role
+	QuarantinePolicyName = "KillSwitchQuarantine"
+	// Max number of accounts fan_out assumes roles in and operates on concurrently
+	FanOutConcurrency = 10
+	// Default DynamoDB table revoke_sessions/apply_scp persist operation manifests to, and undo reads them from
+	DefaultManifestTableName = "KillSwitchManifests"
 )
 
 type Request struct {
-	Action                 Action `json:"action"`
-	TargetAccountID        string `json:"target_account_id"`
-	RoleToAssume           string `json:"role_to_assume"`
-	TargetRoleName         string `json:"target_role_name,omitempty"`       // Used for actions other than apply_scp
-	OrgManagementAccountID string `json:"org_management_account,omitempty"` // Used for apply_scp action
-	Region                 string `json:"region,omitempty"`
+	Action                 Action   `json:"action"`
+	TargetAccountID        string   `json:"target_account_id"`
+	RoleToAssume           string   `json:"role_to_assume"`
+	TargetRoleName         string   `json:"target_role_name,omitempty"`       // Used for actions other than apply_scp; also the principal name for quarantine_principal
+	OrgManagementAccountID string   `json:"org_management_account,omitempty"` // Used for apply_scp action
+	Region                 string   `json:"region,omitempty"`
+	Force                  bool     `json:"force,omitempty"`               // Used for delete_role: keep going past detach/cleanup failures instead of failing fast
+	PrincipalType          string   `json:"principal_type,omitempty"`      // "user" or "role"; used for quarantine_principal
+	ResourceARNs           []string `json:"resource_arns,omitempty"`       // Optional allow-list of resources left out of the quarantine deny
+	ActionPrefixes         []string `json:"action_prefixes,omitempty"`     // Optional allow-list of action prefixes left out of the quarantine deny
+	ConfirmationToken      string   `json:"confirmation_token,omitempty"`  // Must equal TargetAccountID; required for nuke_iam
+	DryRun                 bool     `json:"dry_run,omitempty"`             // Used for nuke_iam: list what would be deleted without deleting
+	PolicySourceURI        string   `json:"policy_source_uri,omitempty"`   // Used for apply_scp: embedded://, s3://bucket/key, secretsmanager://id, or ssm://name
+	PolicyName             string   `json:"policy_name,omitempty"`         // Used for apply_scp: which named SCP in the config to apply, e.g. "deny-all"
+	TargetAccountIDs       []string `json:"target_account_ids,omitempty"`  // Used for fan_out: accounts to apply SubAction in, concurrently
+	SubAction              *Request `json:"sub_action,omitempty"`          // Used for fan_out: the action to apply in each of TargetAccountIDs
+	OperationID            string   `json:"operation_id,omitempty"`        // Used for undo: the operation_id returned by the original revoke_sessions/apply_scp call
+	ManifestTableName      string   `json:"manifest_table_name,omitempty"` // DynamoDB table for operation manifests (default DefaultManifestTableName)
 }
 
+// Config holds a set of named SCPs so a single deployment can serve multiple containment
+// policies, e.g. "deny-all", "deny-data-exfil", "deny-outside-region".
 type Config struct {
-	SwitchConfigVersion string `json:"switchConfigVersion"`
-	SwitchPolicies      struct {
-		SCPolicy json.RawMessage `json:"scpPolicy"`
-	} `json:"switchPolicies"`
+	SwitchConfigVersion string                     `json:"switchConfigVersion"`
+	SwitchPolicies      map[string]json.RawMessage `json:"switchPolicies"`
+}
+
+// OperationManifest records what a revoke_sessions or apply_scp call created, so a later undo
+// call - possibly in a different Lambda invocation - can reverse it. It's persisted to DynamoDB
+// rather than returned-and-forgotten because Lambda invocations don't share memory.
+type OperationManifest struct {
+	OperationID     string `json:"operation_id"`
+	Action          Action `json:"action"`
+	TargetAccountID string `json:"target_account_id"`
+	// ManagementAccountID holds the org management account apply_scp assumed into to call
+	// Organizations; undo needs it because CreatePolicy/AttachPolicy/DetachPolicy/DeletePolicy are
+	// only callable from the management (or delegated-admin) account, not TargetAccountID.
+	ManagementAccountID string `json:"management_account_id,omitempty"`
+	// PolicyARNs holds the identifier DetachPolicy/DeletePolicy need to undo the operation: IAM
+	// policy ARNs for revoke_sessions, Organizations policy IDs for apply_scp.
+	PolicyARNs    []string `json:"policy_arns,omitempty"`
+	AttachedRoles []string `json:"attached_roles,omitempty"` // Roles the policy was attached to, for revoke_sessions
+	CreatedAt     string   `json:"created_at"`
+}
+
+// persistManifest saves an operation manifest so undo can find it later from any invocation.
+func persistManifest(ctx context.Context, sess *session.Session, tableName string, manifest OperationManifest) error {
+	item, err := dynamodbattribute.MarshalMap(manifest)
+	if err != nil {
+		return fmt.Errorf("error marshalling operation manifest: %v", err)
+	}
+	svc := dynamodb.New(sess)
+	if _, err := svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String(tableName), Item: item}); err != nil {
+		return fmt.Errorf("error persisting operation manifest to table %s: %v", tableName, err)
+	}
+	return nil
+}
+
+// formatOperationResult is the structured JSON returned by revoke_sessions/apply_scp, carrying
+// the operation ID and created policy ARN(s)/attachment targets a later undo call needs.
+func formatOperationResult(message string, manifest OperationManifest) (string, error) {
+	payload := struct {
+		Message       string   `json:"message"`
+		OperationID   string   `json:"operation_id"`
+		PolicyARNs    []string `json:"policy_arns,omitempty"`
+		AttachedRoles []string `json:"attached_roles,omitempty"`
+	}{
+		Message:       message,
+		OperationID:   manifest.OperationID,
+		PolicyARNs:    manifest.PolicyARNs,
+		AttachedRoles: manifest.AttachedRoles,
+	}
+	out, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling operation result: %v", err)
+	}
+	return string(out), nil
+}
+
+// manifestTableName resolves the DynamoDB table used for operation manifests: the request field,
+// falling back to an env var, falling back to DefaultManifestTableName.
+func manifestTableName(request Request) string {
+	if request.ManifestTableName != "" {
+		return request.ManifestTableName
+	}
+	if t := os.Getenv("KILLSWITCH_MANIFEST_TABLE"); t != "" {
+		return t
+	}
+	return DefaultManifestTableName
+}
+
+// PolicySource loads a Config from wherever it's stored. Implementations exist for an embedded
+// default, S3, Secrets Manager, and SSM Parameter Store, so the killswitch doesn't depend on
+// os.ReadFile-ing a file that shipped with the Lambda package.
+type PolicySource interface {
+	Load(ctx context.Context, sess *session.Session) (*Config, error)
+}
+
+type embeddedPolicySource struct{}
+
+func (embeddedPolicySource) Load(ctx context.Context, sess *session.Session) (*Config, error) {
+	var config Config
+	if err := json.Unmarshal(defaultPolicyConfig, &config); err != nil {
+		return nil, fmt.Errorf("error parsing embedded policy config: %v", err)
+	}
+	return &config, nil
+}
+
+type s3PolicySource struct {
+	bucket, key string
+}
+
+func (p s3PolicySource) Load(ctx context.Context, sess *session.Session) (*Config, error) {
+	svc := s3.New(sess)
+	out, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(p.bucket), Key: aws.String(p.key)})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching policy config from s3://%s/%s: %v", p.bucket, p.key, err)
+	}
+	defer out.Body.Close()
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading policy config from s3://%s/%s: %v", p.bucket, p.key, err)
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error parsing policy config from s3://%s/%s: %v", p.bucket, p.key, err)
+	}
+	return &config, nil
+}
+
+type secretsManagerPolicySource struct {
+	secretID string
+}
+
+func (p secretsManagerPolicySource) Load(ctx context.Context, sess *session.Session) (*Config, error) {
+	svc := secretsmanager.New(sess)
+	out, err := svc.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(p.secretID)})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching policy config from secret %s: %v", p.secretID, err)
+	}
+	var config Config
+	if err := json.Unmarshal([]byte(aws.StringValue(out.SecretString)), &config); err != nil {
+		return nil, fmt.Errorf("error parsing policy config from secret %s: %v", p.secretID, err)
+	}
+	return &config, nil
+}
+
+type ssmPolicySource struct {
+	parameterName string
+}
+
+func (p ssmPolicySource) Load(ctx context.Context, sess *session.Session) (*Config, error) {
+	svc := ssm.New(sess)
+	out, err := svc.GetParameterWithContext(ctx, &ssm.GetParameterInput{Name: aws.String(p.parameterName), WithDecryption: aws.Bool(true)})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching policy config from ssm parameter %s: %v", p.parameterName, err)
+	}
+	var config Config
+	if err := json.Unmarshal([]byte(aws.StringValue(out.Parameter.Value)), &config); err != nil {
+		return nil, fmt.Errorf("error parsing policy config from ssm parameter %s: %v", p.parameterName, err)
+	}
+	return &config, nil
+}
+
+// resolvePolicySource picks a PolicySource from a URI scheme: embedded:// (the default),
+// s3://bucket/key, secretsmanager://secret-id, or ssm://parameter-name.
+func resolvePolicySource(uri string) (PolicySource, error) {
+	switch {
+	case uri == "", strings.HasPrefix(uri, "embedded://"):
+		return embeddedPolicySource{}, nil
+	case strings.HasPrefix(uri, "s3://"):
+		rest := strings.TrimPrefix(uri, "s3://")
+		parts := strings.SplitN(rest, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid s3 policy source URI %q, expected s3://bucket/key", uri)
+		}
+		return s3PolicySource{bucket: parts[0], key: parts[1]}, nil
+	case strings.HasPrefix(uri, "secretsmanager://"):
+		return secretsManagerPolicySource{secretID: strings.TrimPrefix(uri, "secretsmanager://")}, nil
+	case strings.HasPrefix(uri, "ssm://"):
+		return ssmPolicySource{parameterName: strings.TrimPrefix(uri, "ssm://")}, nil
+	default:
+		return nil, fmt.Errorf("unsupported policy source URI %q", uri)
+	}
 }
 
 func HandleRequest(ctx context.Context, request Request) (string, error) {
-	if request.TargetAccountID == "" || request.RoleToAssume == "" {
-		return "", errors.New("targetAccountID and roleToAssume are required")
+	if request.RoleToAssume == "" {
+		return "", errors.New("roleToAssume is required")
+	}
+	// fan_out targets TargetAccountIDs instead of a single TargetAccountID
+	if request.Action != FanOut && request.TargetAccountID == "" {
+		return "", errors.New("targetAccountID is required")
 	}
 
 	// Default to us-east-1 if Region is not provided
@@ -63,43 +263,70 @@ func HandleRequest(ctx context.Context, request Request) (string, error) {
 		if request.OrgManagementAccountID == "" {
 			return "", errors.New("managementAccount is required for apply_scp action")
 		}
-		// Load SCP from .conf file
-		configFile := "switch.conf"
-		config, err := loadConfig(configFile)
+		policySourceURI := request.PolicySourceURI
+		if policySourceURI == "" {
+			policySourceURI = os.Getenv("KILLSWITCH_POLICY_SOURCE_URI")
+		}
+		config, err := loadConfig(ctx, sess, policySourceURI)
 		if err != nil {
-			return "", fmt.Errorf("error loading config file: %v", err)
+			return "", fmt.Errorf("error loading policy config: %v", err)
 		}
-		return applySCP(ctx, sess, request.OrgManagementAccountID, request.TargetAccountID, request.RoleToAssume, config)
+		policyName := request.PolicyName
+		if policyName == "" {
+			policyName = "deny-all"
+		}
+		return applySCP(ctx, sess, request.OrgManagementAccountID, request.TargetAccountID, request.RoleToAssume, policyName, manifestTableName(request), config)
 	case DetachPolicies, DeleteRole:
 		if request.TargetRoleName == "" {
 			return "", errors.New("targetRoleName is required for this action")
 		}
-		return manageRole(ctx, sess, request.Action, request.TargetAccountID, request.RoleToAssume, request.TargetRoleName)
+		return manageRole(ctx, sess, request.Action, request.TargetAccountID, request.RoleToAssume, request.TargetRoleName, request.Force)
 	case RevokeSessions:
 		if request.TargetRoleName == "" {
 			return "", errors.New("targetRoleName is required for this action")
 		}
-		return revokeSession(ctx, sess, request.TargetAccountID, request.RoleToAssume, request.TargetRoleName)
+		return revokeSession(ctx, sess, request.TargetAccountID, request.RoleToAssume, request.TargetRoleName, manifestTableName(request))
+	case QuarantinePrincipal:
+		if request.TargetRoleName == "" {
+			return "", errors.New("targetRoleName is required as the principal name for quarantine_principal")
+		}
+		if request.PrincipalType != "user" && request.PrincipalType != "role" {
+			return "", errors.New("principalType must be \"user\" or \"role\" for quarantine_principal")
+		}
+		return quarantinePrincipal(ctx, sess, request.TargetAccountID, request.RoleToAssume, request.PrincipalType, request.TargetRoleName, request.ResourceARNs, request.ActionPrefixes)
+	case NukeIAM:
+		if request.ConfirmationToken != request.TargetAccountID {
+			return "", errors.New("confirmationToken must match targetAccountID for nuke_iam action")
+		}
+		return nukeIAM(ctx, sess, request.TargetAccountID, request.RoleToAssume, request.DryRun)
+	case FanOut:
+		if len(request.TargetAccountIDs) == 0 {
+			return "", errors.New("targetAccountIDs is required for fan_out action")
+		}
+		if request.SubAction == nil {
+			return "", errors.New("subAction is required for fan_out action")
+		}
+		return fanOut(ctx, request.TargetAccountIDs, request.RoleToAssume, request.Region, *request.SubAction)
+	case Undo:
+		if request.OperationID == "" {
+			return "", errors.New("operationID is required for undo action")
+		}
+		return undo(ctx, sess, request.TargetAccountID, request.RoleToAssume, request.OperationID, manifestTableName(request))
 	default:
 		return "", errors.New("invalid action")
 	}
 }
 
-// Load awskillswitch.conf if needed
-func loadConfig(filename string) (*Config, error) {
-	var config Config
-	configFile, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, err
-	}
-	err = json.Unmarshal(configFile, &config)
+// loadConfig resolves a PolicySource from uri and loads the Config from it.
+func loadConfig(ctx context.Context, sess *session.Session, uri string) (*Config, error) {
+	source, err := resolvePolicySource(uri)
 	if err != nil {
 		return nil, err
 	}
-	return &config, nil
+	return source.Load(ctx, sess)
 }
 
-func revokeSession(ctx context.Context, sess *session.Session, targetAccountID, roleToAssume, targetRoleName string) (string, error) {
+func revokeSession(ctx context.Context, sess *session.Session, targetAccountID, roleToAssume, targetRoleName, manifestTableName string) (string, error) {
 	// Assume role
 	creds := stscreds.NewCredentials(sess, fmt.Sprintf("arn:aws:iam::%s:role/%s", targetAccountID, roleToAssume))
 	svc := iam.New(sess, &aws.Config{Credentials: creds})
@@ -118,35 +345,67 @@ func revokeSession(ctx context.Context, sess *session.Session, targetAccountID,
         }]
     }`, time.Now().Format(time.RFC3339))
 
-	createPolicyOutput, err := svc.CreatePolicy(&iam.CreatePolicyInput{
-		PolicyName:     aws.String(policyName),
-		PolicyDocument: aws.String(policyDocument),
-		Description:    aws.String("Policy to invalidate all tokens at time of creation"),
+	var createPolicyOutput *iam.CreatePolicyOutput
+	err := withBackoff(ctx, func() error {
+		var err error
+		createPolicyOutput, err = svc.CreatePolicy(&iam.CreatePolicyInput{
+			PolicyName:     aws.String(policyName),
+			PolicyDocument: aws.String(policyDocument),
+			Description:    aws.String("Policy to invalidate all tokens at time of creation"),
+		})
+		return err
 	})
 	if err != nil {
 		return "", fmt.Errorf("error creating new policy: %v", err)
 	}
 
+	manifest := OperationManifest{
+		OperationID:     fmt.Sprintf("%s-%d", RevokeSessions, time.Now().UnixNano()),
+		Action:          RevokeSessions,
+		TargetAccountID: targetAccountID,
+		PolicyARNs:      []string{aws.StringValue(createPolicyOutput.Policy.Arn)},
+		CreatedAt:       time.Now().Format(time.RFC3339),
+	}
+
+	var message string
 	if targetRoleName == "ALL" {
 		// Attach the policy to all roles
-		return revokeSessionAllRoles(ctx, svc, createPolicyOutput.Policy.Arn, roleToAssume)
+		attachedRoles, summary, err := revokeSessionAllRoles(ctx, svc, createPolicyOutput.Policy.Arn, roleToAssume)
+		if err != nil {
+			return "", err
+		}
+		manifest.AttachedRoles = attachedRoles
+		message = summary
 	} else {
 		// Attach the policy to a specific role
-		_, err = svc.AttachRolePolicy(&iam.AttachRolePolicyInput{
-			RoleName:  aws.String(targetRoleName),
-			PolicyArn: createPolicyOutput.Policy.Arn,
+		err = withBackoff(ctx, func() error {
+			_, err := svc.AttachRolePolicy(&iam.AttachRolePolicyInput{
+				RoleName:  aws.String(targetRoleName),
+				PolicyArn: createPolicyOutput.Policy.Arn,
+			})
+			return err
 		})
 		if err != nil {
 			return "", fmt.Errorf("error attaching new policy to role %s in account %s: %v", targetRoleName, targetAccountID, err)
 		}
-		return fmt.Sprintf("New token recovation policy attached to role %s in account %s", targetRoleName, targetAccountID), nil
+		manifest.AttachedRoles = []string{targetRoleName}
+		message = fmt.Sprintf("New token recovation policy attached to role %s in account %s", targetRoleName, targetAccountID)
 	}
+
+	// The policy is already created and attached at this point; a manifest-persist failure must
+	// not discard that containment action, since the caller would have no operation_id to undo it
+	// by and may re-invoke, stacking up duplicate policies. Report it as a warning instead.
+	if err := persistManifest(ctx, sess, manifestTableName, manifest); err != nil {
+		message = fmt.Sprintf("%s (warning: failed to persist operation manifest, undo will not find this operation: %v)", message, err)
+	}
+	return formatOperationResult(message, manifest)
 }
 
-func revokeSessionAllRoles(ctx context.Context, svc *iam.IAM, policyArn *string, assumedRoleName string) (string, error) {
+func revokeSessionAllRoles(ctx context.Context, svc *iam.IAM, policyArn *string, assumedRoleName string) ([]string, string, error) {
 	// List all roles
 	input := &iam.ListRolesInput{}
 	var result strings.Builder
+	var attachedRoles []string
 
 	err := svc.ListRolesPages(input, func(page *iam.ListRolesOutput, lastPage bool) bool {
 		for _, role := range page.Roles {
@@ -156,42 +415,149 @@ func revokeSessionAllRoles(ctx context.Context, svc *iam.IAM, policyArn *string,
 			}
 
 			// Attach the policy to each role
-			_, err := svc.AttachRolePolicy(&iam.AttachRolePolicyInput{
-				RoleName:  role.RoleName,
-				PolicyArn: policyArn,
+			err := withBackoff(ctx, func() error {
+				_, err := svc.AttachRolePolicy(&iam.AttachRolePolicyInput{
+					RoleName:  role.RoleName,
+					PolicyArn: policyArn,
+				})
+				return err
 			})
 			if err != nil {
 				fmt.Printf("Error attaching policy to role %s: %v\n", *role.RoleName, err)
 				continue
 			}
+			attachedRoles = append(attachedRoles, *role.RoleName)
 			result.WriteString(fmt.Sprintf("Policy attached to role %s\n", *role.RoleName))
 		}
 		return !lastPage
 	})
 
 	if err != nil {
-		return "", fmt.Errorf("error attaching policy to roles: %v", err)
+		return nil, "", fmt.Errorf("error attaching policy to roles: %v", err)
 	}
 
-	return result.String(), nil
+	return attachedRoles, result.String(), nil
+}
+
+// quarantinePrincipal puts a scoped deny-all inline policy directly on a user or role. It is a
+// much smaller blast-radius alternative to applySCP when only one identity is compromised.
+func quarantinePrincipal(ctx context.Context, sess *session.Session, targetAccountID, roleToAssume, principalType, principalName string, resourceARNs, actionPrefixes []string) (string, error) {
+	creds := stscreds.NewCredentials(sess, fmt.Sprintf("arn:aws:iam::%s:role/%s", targetAccountID, roleToAssume))
+	svc := iam.New(sess, &aws.Config{Credentials: creds})
+
+	// Default to denying everything; callers pass ResourceARNs/ActionPrefixes to leave break-glass
+	// paths open. Those go in NotAction/NotResource rather than Action/Resource: putting them in
+	// the latter would make the deny apply ONLY to the listed ARNs/prefixes, the opposite of a
+	// break-glass allow-list.
+	statement := struct {
+		Effect      string          `json:"Effect"`
+		Action      json.RawMessage `json:"Action,omitempty"`
+		NotAction   json.RawMessage `json:"NotAction,omitempty"`
+		Resource    json.RawMessage `json:"Resource,omitempty"`
+		NotResource json.RawMessage `json:"NotResource,omitempty"`
+	}{Effect: "Deny"}
+
+	if len(actionPrefixes) > 0 {
+		actionsJSON, err := json.Marshal(actionPrefixes)
+		if err != nil {
+			return "", fmt.Errorf("error marshalling action prefix allow-list: %v", err)
+		}
+		statement.NotAction = actionsJSON
+	} else {
+		statement.Action = json.RawMessage(`"*"`)
+	}
+
+	if len(resourceARNs) > 0 {
+		resourcesJSON, err := json.Marshal(resourceARNs)
+		if err != nil {
+			return "", fmt.Errorf("error marshalling resource allow-list: %v", err)
+		}
+		statement.NotResource = resourcesJSON
+	} else {
+		statement.Resource = json.RawMessage(`"*"`)
+	}
+
+	policyDoc := struct {
+		Version   string        `json:"Version"`
+		Statement []interface{} `json:"Statement"`
+	}{Version: "2012-10-17", Statement: []interface{}{statement}}
+
+	policyDocumentBytes, err := json.Marshal(policyDoc)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling quarantine policy document: %v", err)
+	}
+	policyDocument := string(policyDocumentBytes)
+
+	var previousPolicy string
+	switch principalType {
+	case "user":
+		getOutput, getErr := svc.GetUserPolicy(&iam.GetUserPolicyInput{UserName: aws.String(principalName), PolicyName: aws.String(QuarantinePolicyName)})
+		if getErr == nil {
+			if decoded, err := url.QueryUnescape(aws.StringValue(getOutput.PolicyDocument)); err == nil {
+				previousPolicy = decoded
+			}
+		} else if aerr, ok := getErr.(awserr.Error); !ok || aerr.Code() != iam.ErrCodeNoSuchEntityException {
+			return "", fmt.Errorf("error fetching previous quarantine policy for user %s in account %s: %v", principalName, targetAccountID, getErr)
+		}
+		_, err = svc.PutUserPolicy(&iam.PutUserPolicyInput{
+			UserName:       aws.String(principalName),
+			PolicyName:     aws.String(QuarantinePolicyName),
+			PolicyDocument: aws.String(policyDocument),
+		})
+		if err != nil {
+			return "", fmt.Errorf("error putting quarantine policy on user %s in account %s: %v", principalName, targetAccountID, err)
+		}
+	case "role":
+		getOutput, getErr := svc.GetRolePolicy(&iam.GetRolePolicyInput{RoleName: aws.String(principalName), PolicyName: aws.String(QuarantinePolicyName)})
+		if getErr == nil {
+			if decoded, err := url.QueryUnescape(aws.StringValue(getOutput.PolicyDocument)); err == nil {
+				previousPolicy = decoded
+			}
+		} else if aerr, ok := getErr.(awserr.Error); !ok || aerr.Code() != iam.ErrCodeNoSuchEntityException {
+			return "", fmt.Errorf("error fetching previous quarantine policy for role %s in account %s: %v", principalName, targetAccountID, getErr)
+		}
+		_, err = svc.PutRolePolicy(&iam.PutRolePolicyInput{
+			RoleName:       aws.String(principalName),
+			PolicyName:     aws.String(QuarantinePolicyName),
+			PolicyDocument: aws.String(policyDocument),
+		})
+		if err != nil {
+			return "", fmt.Errorf("error putting quarantine policy on role %s in account %s: %v", principalName, targetAccountID, err)
+		}
+	default:
+		return "", fmt.Errorf("invalid principalType %q, must be \"user\" or \"role\"", principalType)
+	}
+
+	if previousPolicy == "" {
+		previousPolicy = "none"
+	}
+	return fmt.Sprintf("Quarantine policy %s applied to %s %s in account %s; previous policy contents (for rollback): %s", QuarantinePolicyName, principalType, principalName, targetAccountID, previousPolicy), nil
 }
 
-func applySCP(ctx context.Context, sess *session.Session, managementAccount, targetAccountID, roleToAssume string, config *Config) (string, error) {
+func applySCP(ctx context.Context, sess *session.Session, managementAccount, targetAccountID, roleToAssume, policyName, manifestTableName string, config *Config) (string, error) {
+	scpPolicyRaw, ok := config.SwitchPolicies[policyName]
+	if !ok {
+		return "", fmt.Errorf("policy %q not found in config", policyName)
+	}
+	scpPolicy := string(scpPolicyRaw)
+
 	creds := stscreds.NewCredentials(sess, fmt.Sprintf("arn:aws:iam::%s:role/%s", managementAccount, roleToAssume))
 	svc := organizations.New(sess, &aws.Config{Credentials: creds})
 
-	// Convert byte slice to string
-	scpPolicy := string(config.SwitchPolicies.SCPolicy)
-
 	// Create the SCP
 	createPolicyInput := &organizations.CreatePolicyInput{
 		Content:     aws.String(scpPolicy),
-		Description: aws.String("Highly Restrictive SCP"),
-		Name:        aws.String("HighlyRestrictiveSCP"),
+		Description: aws.String(fmt.Sprintf("Killswitch containment SCP: %s", policyName)),
+		Name:        aws.String(fmt.Sprintf("KillSwitchSCP-%s", policyName)),
 		Type:        aws.String("SERVICE_CONTROL_POLICY"),
 	}
 
-	policyResp, err := svc.CreatePolicy(createPolicyInput)
+	var policyResp *organizations.CreatePolicyOutput
+	err := withBackoff(ctx, func() error {
+		var err error
+		policyResp, err = svc.CreatePolicy(createPolicyInput)
+		return err
+	})
 	if err != nil {
 		return "", fmt.Errorf("error creating SCP: %v", err)
 	}
@@ -202,64 +568,658 @@ func applySCP(ctx context.Context, sess *session.Session, managementAccount, tar
 		TargetId: aws.String(targetAccountID),
 	}
 
-	_, err = svc.AttachPolicy(attachPolicyInput)
+	err = withBackoff(ctx, func() error {
+		_, err := svc.AttachPolicy(attachPolicyInput)
+		return err
+	})
 	if err != nil {
 		return "", fmt.Errorf("error attaching SCP to account %s: %v", targetAccountID, err)
 	}
 
-	return fmt.Sprintf("SCP applied to account %s with policy ID %s", targetAccountID, *policyResp.Policy.PolicySummary.Id), nil
+	manifest := OperationManifest{
+		OperationID:         fmt.Sprintf("%s-%d", ApplySCP, time.Now().UnixNano()),
+		Action:              ApplySCP,
+		TargetAccountID:     targetAccountID,
+		ManagementAccountID: managementAccount,
+		PolicyARNs:          []string{aws.StringValue(policyResp.Policy.PolicySummary.Id)},
+		CreatedAt:           time.Now().Format(time.RFC3339),
+	}
+	message := fmt.Sprintf("SCP applied to account %s with policy ID %s", targetAccountID, *policyResp.Policy.PolicySummary.Id)
+	// The SCP is already created and attached at this point; a manifest-persist failure must not
+	// discard that containment action, since the caller would have no operation_id to undo it by
+	// and may re-invoke, stacking up duplicate SCPs. Report it as a warning instead.
+	if err := persistManifest(ctx, sess, manifestTableName, manifest); err != nil {
+		message = fmt.Sprintf("%s (warning: failed to persist operation manifest, undo will not find this operation: %v)", message, err)
+	}
+	return formatOperationResult(message, manifest)
 }
 
 // Actions involving role manipulation or deletion
-func manageRole(ctx context.Context, sess *session.Session, action Action, targetAccountID, roleToAssume, targetRoleName string) (string, error) {
+func manageRole(ctx context.Context, sess *session.Session, action Action, targetAccountID, roleToAssume, targetRoleName string, force bool) (string, error) {
 	creds := stscreds.NewCredentials(sess, fmt.Sprintf("arn:aws:iam::%s:role/%s", targetAccountID, roleToAssume))
 	svc := iam.New(sess, &aws.Config{Credentials: creds})
 
+	var warnings []string
+	// handleErr lets force mode keep going past non-fatal cleanup failures instead of aborting.
+	// Force only applies to delete_role, whose result reports the collected warnings.
+	handleErr := func(err error) error {
+		if err == nil {
+			return nil
+		}
+		if force && action == DeleteRole {
+			warnings = append(warnings, err.Error())
+			return nil
+		}
+		return err
+	}
+
 	// List attached managed policies
-	listPoliciesOutput, err := svc.ListAttachedRolePolicies(&iam.ListAttachedRolePoliciesInput{RoleName: aws.String(targetRoleName)})
+	var listPoliciesOutput *iam.ListAttachedRolePoliciesOutput
+	err := withBackoff(ctx, func() error {
+		var err error
+		listPoliciesOutput, err = svc.ListAttachedRolePolicies(&iam.ListAttachedRolePoliciesInput{RoleName: aws.String(targetRoleName)})
+		return err
+	})
 	if err != nil {
 		return "", fmt.Errorf("error listing attached policies for role %s in account %s: %v", targetRoleName, targetAccountID, err)
 	}
 
 	// Detach each managed policy
 	for _, policy := range listPoliciesOutput.AttachedPolicies {
-		_, err = svc.DetachRolePolicy(&iam.DetachRolePolicyInput{
-			RoleName:  aws.String(targetRoleName),
-			PolicyArn: policy.PolicyArn,
+		err := withBackoff(ctx, func() error {
+			_, err := svc.DetachRolePolicy(&iam.DetachRolePolicyInput{
+				RoleName:  aws.String(targetRoleName),
+				PolicyArn: policy.PolicyArn,
+			})
+			return err
 		})
-		if err != nil {
+		if err := handleErr(err); err != nil {
 			return "", fmt.Errorf("error detaching policy %s from role %s in account %s: %v", *policy.PolicyArn, targetRoleName, targetAccountID, err)
 		}
 	}
 
 	// List inline policies
-	listInlinePoliciesOutput, err := svc.ListRolePolicies(&iam.ListRolePoliciesInput{RoleName: aws.String(targetRoleName)})
+	var listInlinePoliciesOutput *iam.ListRolePoliciesOutput
+	err = withBackoff(ctx, func() error {
+		var err error
+		listInlinePoliciesOutput, err = svc.ListRolePolicies(&iam.ListRolePoliciesInput{RoleName: aws.String(targetRoleName)})
+		return err
+	})
 	if err != nil {
 		return "", fmt.Errorf("error listing inline policies for role %s in account %s: %v", targetRoleName, targetAccountID, err)
 	}
 
 	// Delete each inline policy
 	for _, policyName := range listInlinePoliciesOutput.PolicyNames {
-		_, err = svc.DeleteRolePolicy(&iam.DeleteRolePolicyInput{
-			RoleName:   aws.String(targetRoleName),
-			PolicyName: policyName,
+		err := withBackoff(ctx, func() error {
+			_, err := svc.DeleteRolePolicy(&iam.DeleteRolePolicyInput{
+				RoleName:   aws.String(targetRoleName),
+				PolicyName: policyName,
+			})
+			return err
 		})
-		if err != nil {
+		if err := handleErr(err); err != nil {
 			return "", fmt.Errorf("error deleting inline policy %s from role %s in account %s: %v", *policyName, targetRoleName, targetAccountID, err)
 		}
 	}
 
 	// Delete the role if Action is delete_role
 	if action == DeleteRole {
-		_, err = svc.DeleteRole(&iam.DeleteRoleInput{RoleName: aws.String(targetRoleName)})
+		// Roles with an instance profile or a permission boundary can't be deleted until those
+		// are cleared, and DeleteRole ignores tags/groups/users so those need no extra handling.
+		var listInstanceProfilesOutput *iam.ListInstanceProfilesForRoleOutput
+		err := withBackoff(ctx, func() error {
+			var err error
+			listInstanceProfilesOutput, err = svc.ListInstanceProfilesForRole(&iam.ListInstanceProfilesForRoleInput{RoleName: aws.String(targetRoleName)})
+			return err
+		})
+		if err := handleErr(err); err != nil {
+			return "", fmt.Errorf("error listing instance profiles for role %s in account %s: %v", targetRoleName, targetAccountID, err)
+		}
+		for _, profile := range listInstanceProfilesOutput.InstanceProfiles {
+			err := withBackoff(ctx, func() error {
+				_, err := svc.RemoveRoleFromInstanceProfile(&iam.RemoveRoleFromInstanceProfileInput{
+					InstanceProfileName: profile.InstanceProfileName,
+					RoleName:            aws.String(targetRoleName),
+				})
+				return err
+			})
+			if err := handleErr(err); err != nil {
+				return "", fmt.Errorf("error removing role %s from instance profile %s in account %s: %v", targetRoleName, *profile.InstanceProfileName, targetAccountID, err)
+			}
+			// Only delete the instance profile if this was its last role.
+			if force && len(profile.Roles) <= 1 {
+				if err := withBackoff(ctx, func() error {
+					_, err := svc.DeleteInstanceProfile(&iam.DeleteInstanceProfileInput{InstanceProfileName: profile.InstanceProfileName})
+					return err
+				}); err != nil {
+					warnings = append(warnings, fmt.Sprintf("error deleting instance profile %s: %v", *profile.InstanceProfileName, err))
+				}
+			}
+		}
+
+		// Clear the permission boundary, if any; the API call is a no-op if none is set.
+		if err := withBackoff(ctx, func() error {
+			_, err := svc.DeleteRolePermissionsBoundary(&iam.DeleteRolePermissionsBoundaryInput{RoleName: aws.String(targetRoleName)})
+			return err
+		}); err != nil {
+			if err := handleErr(err); err != nil {
+				return "", fmt.Errorf("error removing permissions boundary from role %s in account %s: %v", targetRoleName, targetAccountID, err)
+			}
+		}
+
+		err = withBackoff(ctx, func() error {
+			_, err := svc.DeleteRole(&iam.DeleteRoleInput{RoleName: aws.String(targetRoleName)})
+			return err
+		})
 		if err != nil {
 			return "", fmt.Errorf("error deleting role %s in account %s: %v", targetRoleName, targetAccountID, err)
 		}
-		return fmt.Sprintf("Role %s and its policies are detached and deleted in account %s", targetRoleName, targetAccountID), nil
+		result := fmt.Sprintf("Role %s and its policies are detached and deleted in account %s", targetRoleName, targetAccountID)
+		if len(warnings) > 0 {
+			result = fmt.Sprintf("%s (%d non-fatal warnings: %s)", result, len(warnings), strings.Join(warnings, "; "))
+		}
+		return result, nil
 	}
 	return fmt.Sprintf("Policies detached from role %s in account %s", targetRoleName, targetAccountID), nil
 }
 
+// nukeIAM deletes every user, role, group, and customer-managed policy it finds in the target
+// account, in the dependency order cloud-nuke's IAM subsystem uses: group memberships and access
+// keys/login profiles/MFA devices first, then policy detachment, then the entities themselves.
+// It keeps going past individual failures and reports them per-resource in the returned summary.
+func nukeIAM(ctx context.Context, sess *session.Session, targetAccountID, roleToAssume string, dryRun bool) (string, error) {
+	creds := stscreds.NewCredentials(sess, fmt.Sprintf("arn:aws:iam::%s:role/%s", targetAccountID, roleToAssume))
+	svc := iam.New(sess, &aws.Config{Credentials: creds})
+
+	var result strings.Builder
+	verb := "Deleted"
+	if dryRun {
+		verb = "Would delete"
+		result.WriteString("Dry run: no resources were deleted\n")
+	}
+	logOK := func(format string, args ...interface{}) {
+		result.WriteString(fmt.Sprintf("%s %s\n", verb, fmt.Sprintf(format, args...)))
+	}
+	logErr := func(format string, args ...interface{}) {
+		result.WriteString(fmt.Sprintf("Error: %s\n", fmt.Sprintf(format, args...)))
+	}
+
+	// Users: delete access keys and login profile, deactivate MFA devices, leave groups, detach/delete policies,
+	// then the user itself.
+	err := svc.ListUsersPages(&iam.ListUsersInput{}, func(page *iam.ListUsersOutput, lastPage bool) bool {
+		for _, user := range page.Users {
+			userName := user.UserName
+			if !dryRun {
+				var keysOutput *iam.ListAccessKeysOutput
+				if err := withBackoff(ctx, func() error {
+					var err error
+					keysOutput, err = svc.ListAccessKeys(&iam.ListAccessKeysInput{UserName: userName})
+					return err
+				}); err != nil {
+					logErr("listing access keys for user %s: %v", *userName, err)
+				} else {
+					for _, key := range keysOutput.AccessKeyMetadata {
+						if err := withBackoff(ctx, func() error {
+							_, err := svc.DeleteAccessKey(&iam.DeleteAccessKeyInput{UserName: userName, AccessKeyId: key.AccessKeyId})
+							return err
+						}); err != nil {
+							logErr("deleting access key %s for user %s: %v", *key.AccessKeyId, *userName, err)
+						}
+					}
+				}
+
+				if err := withBackoff(ctx, func() error {
+					_, err := svc.DeleteLoginProfile(&iam.DeleteLoginProfileInput{UserName: userName})
+					return err
+				}); err != nil {
+					if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != iam.ErrCodeNoSuchEntityException {
+						logErr("deleting login profile for user %s: %v", *userName, err)
+					}
+				}
+
+				var mfaOutput *iam.ListMFADevicesOutput
+				if err := withBackoff(ctx, func() error {
+					var err error
+					mfaOutput, err = svc.ListMFADevices(&iam.ListMFADevicesInput{UserName: userName})
+					return err
+				}); err != nil {
+					logErr("listing MFA devices for user %s: %v", *userName, err)
+				} else {
+					for _, device := range mfaOutput.MFADevices {
+						if err := withBackoff(ctx, func() error {
+							_, err := svc.DeactivateMFADevice(&iam.DeactivateMFADeviceInput{UserName: userName, SerialNumber: device.SerialNumber})
+							return err
+						}); err != nil {
+							logErr("deactivating MFA device %s for user %s: %v", *device.SerialNumber, *userName, err)
+						}
+					}
+				}
+
+				var groupsOutput *iam.ListGroupsForUserOutput
+				if err := withBackoff(ctx, func() error {
+					var err error
+					groupsOutput, err = svc.ListGroupsForUser(&iam.ListGroupsForUserInput{UserName: userName})
+					return err
+				}); err != nil {
+					logErr("listing groups for user %s: %v", *userName, err)
+				} else {
+					for _, group := range groupsOutput.Groups {
+						if err := withBackoff(ctx, func() error {
+							_, err := svc.RemoveUserFromGroup(&iam.RemoveUserFromGroupInput{UserName: userName, GroupName: group.GroupName})
+							return err
+						}); err != nil {
+							logErr("removing user %s from group %s: %v", *userName, *group.GroupName, err)
+						}
+					}
+				}
+
+				var attachedOutput *iam.ListAttachedUserPoliciesOutput
+				if err := withBackoff(ctx, func() error {
+					var err error
+					attachedOutput, err = svc.ListAttachedUserPolicies(&iam.ListAttachedUserPoliciesInput{UserName: userName})
+					return err
+				}); err != nil {
+					logErr("listing attached policies for user %s: %v", *userName, err)
+				} else {
+					for _, policy := range attachedOutput.AttachedPolicies {
+						if err := withBackoff(ctx, func() error {
+							_, err := svc.DetachUserPolicy(&iam.DetachUserPolicyInput{UserName: userName, PolicyArn: policy.PolicyArn})
+							return err
+						}); err != nil {
+							logErr("detaching policy %s from user %s: %v", *policy.PolicyArn, *userName, err)
+						}
+					}
+				}
+
+				var inlineOutput *iam.ListUserPoliciesOutput
+				if err := withBackoff(ctx, func() error {
+					var err error
+					inlineOutput, err = svc.ListUserPolicies(&iam.ListUserPoliciesInput{UserName: userName})
+					return err
+				}); err != nil {
+					logErr("listing inline policies for user %s: %v", *userName, err)
+				} else {
+					for _, policyName := range inlineOutput.PolicyNames {
+						if err := withBackoff(ctx, func() error {
+							_, err := svc.DeleteUserPolicy(&iam.DeleteUserPolicyInput{UserName: userName, PolicyName: policyName})
+							return err
+						}); err != nil {
+							logErr("deleting inline policy %s from user %s: %v", *policyName, *userName, err)
+						}
+					}
+				}
+
+				if err := withBackoff(ctx, func() error {
+					_, err := svc.DeleteUser(&iam.DeleteUserInput{UserName: userName})
+					return err
+				}); err != nil {
+					logErr("deleting user %s: %v", *userName, err)
+					continue
+				}
+			}
+			logOK("user %s", *userName)
+		}
+		return !lastPage
+	})
+	if err != nil {
+		logErr("listing users: %v", err)
+	}
+
+	// Groups: detach managed policies and delete inline policies, then the group itself.
+	err = svc.ListGroupsPages(&iam.ListGroupsInput{}, func(page *iam.ListGroupsOutput, lastPage bool) bool {
+		for _, group := range page.Groups {
+			groupName := group.GroupName
+			if !dryRun {
+				var attachedOutput *iam.ListAttachedGroupPoliciesOutput
+				if err := withBackoff(ctx, func() error {
+					var err error
+					attachedOutput, err = svc.ListAttachedGroupPolicies(&iam.ListAttachedGroupPoliciesInput{GroupName: groupName})
+					return err
+				}); err != nil {
+					logErr("listing attached policies for group %s: %v", *groupName, err)
+				} else {
+					for _, policy := range attachedOutput.AttachedPolicies {
+						if err := withBackoff(ctx, func() error {
+							_, err := svc.DetachGroupPolicy(&iam.DetachGroupPolicyInput{GroupName: groupName, PolicyArn: policy.PolicyArn})
+							return err
+						}); err != nil {
+							logErr("detaching policy %s from group %s: %v", *policy.PolicyArn, *groupName, err)
+						}
+					}
+				}
+
+				var inlineOutput *iam.ListGroupPoliciesOutput
+				if err := withBackoff(ctx, func() error {
+					var err error
+					inlineOutput, err = svc.ListGroupPolicies(&iam.ListGroupPoliciesInput{GroupName: groupName})
+					return err
+				}); err != nil {
+					logErr("listing inline policies for group %s: %v", *groupName, err)
+				} else {
+					for _, policyName := range inlineOutput.PolicyNames {
+						if err := withBackoff(ctx, func() error {
+							_, err := svc.DeleteGroupPolicy(&iam.DeleteGroupPolicyInput{GroupName: groupName, PolicyName: policyName})
+							return err
+						}); err != nil {
+							logErr("deleting inline policy %s from group %s: %v", *policyName, *groupName, err)
+						}
+					}
+				}
+
+				if err := withBackoff(ctx, func() error {
+					_, err := svc.DeleteGroup(&iam.DeleteGroupInput{GroupName: groupName})
+					return err
+				}); err != nil {
+					logErr("deleting group %s: %v", *groupName, err)
+					continue
+				}
+			}
+			logOK("group %s", *groupName)
+		}
+		return !lastPage
+	})
+	if err != nil {
+		logErr("listing groups: %v", err)
+	}
+
+	// Roles: reuse manageRole's instance profile/policy cleanup in force mode, then delete the role.
+	// The role this Lambda assumed is skipped so containment doesn't cut off its own access mid-run.
+	err = svc.ListRolesPages(&iam.ListRolesInput{}, func(page *iam.ListRolesOutput, lastPage bool) bool {
+		for _, role := range page.Roles {
+			roleName := role.RoleName
+			if *roleName == roleToAssume {
+				continue
+			}
+			if !dryRun {
+				if _, err := manageRole(ctx, sess, DeleteRole, targetAccountID, roleToAssume, *roleName, true); err != nil {
+					logErr("deleting role %s: %v", *roleName, err)
+					continue
+				}
+			}
+			logOK("role %s", *roleName)
+		}
+		return !lastPage
+	})
+	if err != nil {
+		logErr("listing roles: %v", err)
+	}
+
+	// Customer-managed policies: detach from every remaining entity and delete non-default
+	// versions, then the policy itself.
+	err = svc.ListPoliciesPages(&iam.ListPoliciesInput{Scope: aws.String(iam.PolicyScopeTypeLocal)}, func(page *iam.ListPoliciesOutput, lastPage bool) bool {
+		for _, policy := range page.Policies {
+			policyArn := policy.Arn
+			if !dryRun {
+				var entitiesOutput *iam.ListEntitiesForPolicyOutput
+				if err := withBackoff(ctx, func() error {
+					var err error
+					entitiesOutput, err = svc.ListEntitiesForPolicy(&iam.ListEntitiesForPolicyInput{PolicyArn: policyArn})
+					return err
+				}); err != nil {
+					logErr("listing entities for policy %s: %v", *policyArn, err)
+				} else {
+					for _, u := range entitiesOutput.PolicyUsers {
+						if err := withBackoff(ctx, func() error {
+							_, err := svc.DetachUserPolicy(&iam.DetachUserPolicyInput{UserName: u.UserName, PolicyArn: policyArn})
+							return err
+						}); err != nil {
+							logErr("detaching policy %s from user %s: %v", *policyArn, *u.UserName, err)
+						}
+					}
+					for _, r := range entitiesOutput.PolicyRoles {
+						if err := withBackoff(ctx, func() error {
+							_, err := svc.DetachRolePolicy(&iam.DetachRolePolicyInput{RoleName: r.RoleName, PolicyArn: policyArn})
+							return err
+						}); err != nil {
+							logErr("detaching policy %s from role %s: %v", *policyArn, *r.RoleName, err)
+						}
+					}
+					for _, g := range entitiesOutput.PolicyGroups {
+						if err := withBackoff(ctx, func() error {
+							_, err := svc.DetachGroupPolicy(&iam.DetachGroupPolicyInput{GroupName: g.GroupName, PolicyArn: policyArn})
+							return err
+						}); err != nil {
+							logErr("detaching policy %s from group %s: %v", *policyArn, *g.GroupName, err)
+						}
+					}
+				}
+
+				var versionsOutput *iam.ListPolicyVersionsOutput
+				if err := withBackoff(ctx, func() error {
+					var err error
+					versionsOutput, err = svc.ListPolicyVersions(&iam.ListPolicyVersionsInput{PolicyArn: policyArn})
+					return err
+				}); err != nil {
+					logErr("listing versions for policy %s: %v", *policyArn, err)
+				} else {
+					for _, version := range versionsOutput.Versions {
+						if aws.BoolValue(version.IsDefaultVersion) {
+							continue
+						}
+						if err := withBackoff(ctx, func() error {
+							_, err := svc.DeletePolicyVersion(&iam.DeletePolicyVersionInput{PolicyArn: policyArn, VersionId: version.VersionId})
+							return err
+						}); err != nil {
+							logErr("deleting version %s of policy %s: %v", *version.VersionId, *policyArn, err)
+						}
+					}
+				}
+
+				if err := withBackoff(ctx, func() error {
+					_, err := svc.DeletePolicy(&iam.DeletePolicyInput{PolicyArn: policyArn})
+					return err
+				}); err != nil {
+					logErr("deleting policy %s: %v", *policyArn, err)
+					continue
+				}
+			}
+			logOK("policy %s", *policyArn)
+		}
+		return !lastPage
+	})
+	if err != nil {
+		logErr("listing policies: %v", err)
+	}
+
+	return result.String(), nil
+}
+
+// fanOutLogEntry is the structured per-account JSON log line fan_out emits for SIEM ingestion.
+type fanOutLogEntry struct {
+	AccountID string `json:"account_id"`
+	Action    Action `json:"action"`
+	Result    string `json:"result,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// fanOut applies subAction in each of targetAccountIDs concurrently, bounded by FanOutConcurrency,
+// so a single invocation can contain a compromise across dozens of accounts at once. Individual
+// account failures are surfaced in the per-account result map rather than short-circuiting the rest.
+func fanOut(ctx context.Context, targetAccountIDs []string, roleToAssume, region string, subAction Request) (string, error) {
+	sem := make(chan struct{}, FanOutConcurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	results := make(map[string]string, len(targetAccountIDs))
+
+	for _, accountID := range targetAccountIDs {
+		wg.Add(1)
+		go func(accountID string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			req := subAction
+			req.TargetAccountID = accountID
+			if req.RoleToAssume == "" {
+				req.RoleToAssume = roleToAssume
+			}
+			if req.Region == "" {
+				req.Region = region
+			}
+			if req.Action == NukeIAM {
+				// nuke_iam requires ConfirmationToken == TargetAccountID as a deliberate
+				// per-account confirmation; rewrite it per account like the fields above,
+				// otherwise only the one account matching the caller's literal token succeeds.
+				req.ConfirmationToken = accountID
+			}
+
+			// HandleRequest itself is not retried here: several of its actions (e.g. revoke_sessions,
+			// apply_scp) create new, uniquely-named resources as a side effect, so retrying the whole
+			// call on a late throttling error would create duplicate containment artifacts instead of
+			// just retrying the failed AWS call. Backoff lives around the individual AWS SDK calls
+			// those actions make instead.
+			entry := fanOutLogEntry{AccountID: accountID, Action: req.Action}
+			output, err := HandleRequest(ctx, req)
+			if err != nil {
+				entry.Error = err.Error()
+			} else {
+				entry.Result = output
+			}
+
+			// One JSON line per account for downstream SIEM ingestion.
+			if logLine, err := json.Marshal(entry); err == nil {
+				fmt.Println(string(logLine))
+			}
+
+			mu.Lock()
+			if entry.Error != "" {
+				results[accountID] = fmt.Sprintf("error: %s", entry.Error)
+			} else {
+				results[accountID] = entry.Result
+			}
+			mu.Unlock()
+		}(accountID)
+	}
+	wg.Wait()
+
+	summary, err := json.Marshal(results)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling fan-out results: %v", err)
+	}
+	return string(summary), nil
+}
+
+// withBackoff retries fn with exponential backoff and jitter when it fails with an AWS throttling
+// error, so a single AWS SDK call survives STS/IAM rate limits when fan_out hits dozens of accounts
+// at once. fn should wrap one individual AWS call, not a whole action, so a retry can't duplicate
+// side effects (e.g. re-creating a policy) that already took effect before the throttling error.
+func withBackoff(ctx context.Context, fn func() error) error {
+	const maxAttempts = 5
+	const baseDelay = 200 * time.Millisecond
+
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if !isThrottlingError(err) {
+			return err
+		}
+		backoff := time.Duration(math.Pow(2, float64(attempt))) * baseDelay
+		jitter := time.Duration(rand.Int63n(int64(backoff)))
+		select {
+		case <-time.After(backoff + jitter):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+func isThrottlingError(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case "Throttling", "ThrottlingException", "TooManyRequestsException", "RequestLimitExceeded":
+		return true
+	default:
+		return false
+	}
+}
+
+// undo reverses a prior revoke_sessions or apply_scp operation by looking up its manifest in
+// DynamoDB and detaching/deleting whatever it created. It refuses to proceed if no manifest is
+// found for operationID rather than guessing at what to clean up.
+func undo(ctx context.Context, sess *session.Session, targetAccountID, roleToAssume, operationID, manifestTableName string) (string, error) {
+	ddb := dynamodb.New(sess)
+	getItemOutput, err := ddb.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(manifestTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"operation_id": {S: aws.String(operationID)},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error looking up operation manifest %s: %v", operationID, err)
+	}
+	if len(getItemOutput.Item) == 0 {
+		return "", fmt.Errorf("no operation manifest found for operation_id %s; refusing to undo", operationID)
+	}
+
+	var manifest OperationManifest
+	if err := dynamodbattribute.UnmarshalMap(getItemOutput.Item, &manifest); err != nil {
+		return "", fmt.Errorf("error unmarshalling operation manifest %s: %v", operationID, err)
+	}
+
+	switch manifest.Action {
+	case RevokeSessions:
+		// The manifest, not the caller-supplied targetAccountID, is the source of truth for which
+		// account this operation applied to; see the ApplySCP case below.
+		creds := stscreds.NewCredentials(sess, fmt.Sprintf("arn:aws:iam::%s:role/%s", manifest.TargetAccountID, roleToAssume))
+		svc := iam.New(sess, &aws.Config{Credentials: creds})
+		for _, policyArn := range manifest.PolicyARNs {
+			for _, roleName := range manifest.AttachedRoles {
+				_, err := svc.DetachRolePolicy(&iam.DetachRolePolicyInput{
+					RoleName:  aws.String(roleName),
+					PolicyArn: aws.String(policyArn),
+				})
+				if err != nil {
+					return "", fmt.Errorf("error detaching policy %s from role %s: %v", policyArn, roleName, err)
+				}
+			}
+			if _, err := svc.DeletePolicy(&iam.DeletePolicyInput{PolicyArn: aws.String(policyArn)}); err != nil {
+				return "", fmt.Errorf("error deleting policy %s: %v", policyArn, err)
+			}
+		}
+	case ApplySCP:
+		if manifest.ManagementAccountID == "" {
+			return "", fmt.Errorf("operation manifest %s has no management_account_id; cannot undo apply_scp", operationID)
+		}
+		// Organizations APIs are only callable from the management (or delegated-admin) account,
+		// not the contained account the SCP was attached to.
+		creds := stscreds.NewCredentials(sess, fmt.Sprintf("arn:aws:iam::%s:role/%s", manifest.ManagementAccountID, roleToAssume))
+		svc := organizations.New(sess, &aws.Config{Credentials: creds})
+		for _, policyID := range manifest.PolicyARNs {
+			_, err := svc.DetachPolicy(&organizations.DetachPolicyInput{
+				PolicyId: aws.String(policyID),
+				TargetId: aws.String(manifest.TargetAccountID),
+			})
+			if err != nil {
+				return "", fmt.Errorf("error detaching SCP %s from account %s: %v", policyID, manifest.TargetAccountID, err)
+			}
+			if _, err := svc.DeletePolicy(&organizations.DeletePolicyInput{PolicyId: aws.String(policyID)}); err != nil {
+				return "", fmt.Errorf("error deleting SCP %s: %v", policyID, err)
+			}
+		}
+	default:
+		return "", fmt.Errorf("undo is not supported for action %s", manifest.Action)
+	}
+
+	if _, err := ddb.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(manifestTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"operation_id": {S: aws.String(operationID)},
+		},
+	}); err != nil {
+		return "", fmt.Errorf("error deleting operation manifest %s after undo: %v", operationID, err)
+	}
+
+	return fmt.Sprintf("Operation %s (%s) undone for account %s", operationID, manifest.Action, manifest.TargetAccountID), nil
+}
+
 func main() {
 	lambda.Start(HandleRequest)
 }
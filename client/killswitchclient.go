@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -14,20 +15,36 @@ import (
 type ActionType string
 
 const (
-	ApplySCP       ActionType = "apply_scp"
-	DeleteRole     ActionType = "delete_role"
-	DetachPolicies ActionType = "detach_policies"
-	RevokeSessions ActionType = "revoke_sessions"
+	ApplySCP            ActionType = "apply_scp"
+	DeleteRole          ActionType = "delete_role"
+	DetachPolicies      ActionType = "detach_policies"
+	RevokeSessions      ActionType = "revoke_sessions"
+	QuarantinePrincipal ActionType = "quarantine_principal"
+	NukeIAM             ActionType = "nuke_iam"
+	FanOut              ActionType = "fan_out"
+	Undo                ActionType = "undo"
 )
 
 // LambdaRequest defines the payload structure to send to the Lambda function
 type LambdaRequest struct {
-	Action                 ActionType `json:"action"`
-	TargetAccountID        string     `json:"target_account_id"`
-	RoleToAssume           string     `json:"role_to_assume"`
-	TargetRoleName         string     `json:"target_role_name,omitempty"`       // Role name for actions other than apply_scp
-	OrgManagementAccountID string     `json:"org_management_account,omitempty"` // Management account ID for apply_scp
-	Region                 string     `json:"region,omitempty"`
+	Action                 ActionType     `json:"action"`
+	TargetAccountID        string         `json:"target_account_id"`
+	RoleToAssume           string         `json:"role_to_assume"`
+	TargetRoleName         string         `json:"target_role_name,omitempty"`       // Role name for actions other than apply_scp; also the principal name for quarantine_principal
+	OrgManagementAccountID string         `json:"org_management_account,omitempty"` // Management account ID for apply_scp
+	Region                 string         `json:"region,omitempty"`
+	Force                  bool           `json:"force,omitempty"`               // Keep going past cleanup failures for delete_role
+	PrincipalType          string         `json:"principal_type,omitempty"`      // "user" or "role"; used for quarantine_principal
+	ResourceARNs           []string       `json:"resource_arns,omitempty"`       // Optional allow-list of resources left out of the quarantine deny
+	ActionPrefixes         []string       `json:"action_prefixes,omitempty"`     // Optional allow-list of action prefixes left out of the quarantine deny
+	ConfirmationToken      string         `json:"confirmation_token,omitempty"`  // Must equal TargetAccountID; required for nuke_iam
+	DryRun                 bool           `json:"dry_run,omitempty"`             // For nuke_iam only: list what would be deleted without deleting
+	PolicySourceURI        string         `json:"policy_source_uri,omitempty"`   // For apply_scp only: embedded://, s3://bucket/key, secretsmanager://id, or ssm://name
+	PolicyName             string         `json:"policy_name,omitempty"`         // For apply_scp only: which named SCP in the config to apply, e.g. "deny-all"
+	TargetAccountIDs       []string       `json:"target_account_ids,omitempty"`  // For fan_out only: accounts to apply SubAction in, concurrently
+	SubAction              *LambdaRequest `json:"sub_action,omitempty"`          // For fan_out only: the action to apply in each of TargetAccountIDs
+	OperationID            string         `json:"operation_id,omitempty"`        // For undo only: the operation_id returned by the original revoke_sessions/apply_scp call
+	ManifestTableName      string         `json:"manifest_table_name,omitempty"` // DynamoDB table for operation manifests (defaults to the Lambda's configured table)
 }
 
 // invokeLambda calls a Lambda function with the provided payload
@@ -61,19 +78,51 @@ func main() {
 		targetRoleFlag         string
 		orgManagementAccountID string
 		regionFlag             string
+		forceFlag              bool
+		principalTypeFlag      string
+		resourceARNsFlag       string
+		actionPrefixesFlag     string
+		confirmationTokenFlag  string
+		dryRunFlag             bool
+		policySourceURIFlag    string
+		policyNameFlag         string
+		targetAccountsFlag     string
+		subActionFlag          string
+		operationIDFlag        string
+		manifestTableNameFlag  string
 	)
-	flag.StringVar(&actionFlag, "action", "", "Action to perform: 'apply_scp', 'delete_role', 'detach_policies', or 'revoke_sessions")
+	flag.StringVar(&actionFlag, "action", "", "Action to perform: 'apply_scp', 'delete_role', 'detach_policies', 'revoke_sessions', 'quarantine_principal', 'nuke_iam', 'fan_out', or 'undo'")
 	flag.StringVar(&lambdaFlag, "lambda", "", "Lambda function name or ARN")
 	flag.StringVar(&targetAccountFlag, "target_account", "", "AWS target account ID to perform the action on")
 	flag.StringVar(&roleToAssumeFlag, "role_to_assume", "", "Role to assume when performing the action")
 	flag.StringVar(&targetRoleFlag, "target_role", "", "IAM role name to delete, detach, or revoke sessions on. Required for actions other than 'apply_scp (for delete_role, detach_policies, or revoke_sessions only). Specify ALL to revoke all sessions on all roles when using the revoke_sessions action.")
 	flag.StringVar(&orgManagementAccountID, "org_management_account", "", "AWS Org Management Account ID (for apply_scp only)")
 	flag.StringVar(&regionFlag, "region", "", "AWS region of the Lambda function")
+	flag.BoolVar(&forceFlag, "force", false, "For delete_role only: keep going past policy detach/delete and instance profile/permission boundary cleanup failures instead of failing fast")
+	flag.StringVar(&principalTypeFlag, "principal_type", "", "\"user\" or \"role\" (for quarantine_principal only)")
+	flag.StringVar(&resourceARNsFlag, "resource_arns", "", "Comma-separated resource ARNs left out of the quarantine deny (for quarantine_principal only)")
+	flag.StringVar(&actionPrefixesFlag, "action_prefixes", "", "Comma-separated action prefixes left out of the quarantine deny (for quarantine_principal only)")
+	flag.StringVar(&confirmationTokenFlag, "confirmation_token", "", "Must equal target_account; required for nuke_iam")
+	flag.BoolVar(&dryRunFlag, "dry_run", false, "For nuke_iam only: list what would be deleted without deleting")
+	flag.StringVar(&policySourceURIFlag, "policy_source_uri", "", "For apply_scp only: embedded://, s3://bucket/key, secretsmanager://id, or ssm://name (defaults to the Lambda's KILLSWITCH_POLICY_SOURCE_URI env var, else its embedded config)")
+	flag.StringVar(&policyNameFlag, "policy_name", "", "For apply_scp only: which named SCP in the config to apply, e.g. \"deny-all\" (default \"deny-all\")")
+	flag.StringVar(&targetAccountsFlag, "target_accounts", "", "Comma-separated AWS account IDs to fan out to (for fan_out only; 'target_account' is ignored)")
+	flag.StringVar(&subActionFlag, "sub_action", "", "Action to apply in each of 'target_accounts' (for fan_out only; any of the other action-specific flags are reused)")
+	flag.StringVar(&operationIDFlag, "operation_id", "", "Operation ID returned by the original revoke_sessions/apply_scp call (for undo only)")
+	flag.StringVar(&manifestTableNameFlag, "manifest_table_name", "", "DynamoDB table for operation manifests (defaults to the Lambda's configured table)")
 	flag.Parse()
 
 	// Validate flags
-	if actionFlag == "" || lambdaFlag == "" || targetAccountFlag == "" || roleToAssumeFlag == "" {
-		fmt.Println("Required flags not provided. 'action', 'lambda', 'target_account', and 'role_to_assume' are mandatory.")
+	if actionFlag == "" || lambdaFlag == "" || roleToAssumeFlag == "" {
+		fmt.Println("Required flags not provided. 'action', 'lambda', and 'role_to_assume' are mandatory.")
+		os.Exit(1)
+	}
+	if actionFlag != string(FanOut) && targetAccountFlag == "" {
+		fmt.Println("The 'target_account' flag is mandatory for actions other than 'fan_out'.")
+		os.Exit(1)
+	}
+	if actionFlag == string(FanOut) && (targetAccountsFlag == "" || subActionFlag == "") {
+		fmt.Println("For 'fan_out' action, 'target_accounts' and 'sub_action' flags are also required.")
 		os.Exit(1)
 	}
 	if actionFlag == string(ApplySCP) && orgManagementAccountID == "" {
@@ -84,6 +133,26 @@ func main() {
 		fmt.Println("The 'target_role' flag is required for actions other than 'apply_scp'.")
 		os.Exit(1)
 	}
+	if actionFlag == string(QuarantinePrincipal) && (targetRoleFlag == "" || (principalTypeFlag != "user" && principalTypeFlag != "role")) {
+		fmt.Println("For 'quarantine_principal' action, 'target_role' (the principal name) and 'principal_type' ('user' or 'role') flags are also required.")
+		os.Exit(1)
+	}
+	if actionFlag == string(NukeIAM) && confirmationTokenFlag != targetAccountFlag {
+		fmt.Println("For 'nuke_iam' action, 'confirmation_token' must equal 'target_account'.")
+		os.Exit(1)
+	}
+	if actionFlag == string(Undo) && operationIDFlag == "" {
+		fmt.Println("The 'operation_id' flag is required for the 'undo' action.")
+		os.Exit(1)
+	}
+
+	var resourceARNs, actionPrefixes []string
+	if resourceARNsFlag != "" {
+		resourceARNs = strings.Split(resourceARNsFlag, ",")
+	}
+	if actionPrefixesFlag != "" {
+		actionPrefixes = strings.Split(actionPrefixesFlag, ",")
+	}
 
 	// Build the request payload based on the action
 	request := LambdaRequest{
@@ -93,6 +162,26 @@ func main() {
 		TargetRoleName:         targetRoleFlag,
 		OrgManagementAccountID: orgManagementAccountID,
 		Region:                 regionFlag,
+		Force:                  forceFlag,
+		PrincipalType:          principalTypeFlag,
+		ResourceARNs:           resourceARNs,
+		ActionPrefixes:         actionPrefixes,
+		ConfirmationToken:      confirmationTokenFlag,
+		DryRun:                 dryRunFlag,
+		PolicySourceURI:        policySourceURIFlag,
+		PolicyName:             policyNameFlag,
+		OperationID:            operationIDFlag,
+		ManifestTableName:      manifestTableNameFlag,
+	}
+
+	if actionFlag == string(FanOut) {
+		request.TargetAccountID = ""
+		request.TargetAccountIDs = strings.Split(targetAccountsFlag, ",")
+		subAction := request
+		subAction.Action = ActionType(subActionFlag)
+		subAction.TargetAccountIDs = nil
+		subAction.SubAction = nil
+		request.SubAction = &subAction
 	}
 
 	// Marshal the request into JSON